@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/garyburd/redigo/redis"
+	es "github.com/launchdarkly/eventsource"
+	nats "github.com/nats-io/go-nats"
+)
+
+// Broadcaster decouples a relay feature store from the transport used to
+// fan flag/segment updates out to subscribers. The default is SSEBroadcaster
+// (direct delivery to locally-connected SSE clients) behind a
+// QueuedBroadcaster, but operators running
+// several relay replicas behind a load balancer can publish to a shared
+// Redis or NATS bus instead, so that every replica's SSE clients see the
+// same updates without each replica independently polling LaunchDarkly.
+type Broadcaster interface {
+	PublishAll(keys []string, event es.Event)
+	PublishFlags(keys []string, event es.Event)
+}
+
+// SSEBroadcaster is the original behavior: publish directly to the two
+// local eventsource servers.
+type SSEBroadcaster struct {
+	allPublisher   *es.Server
+	flagsPublisher *es.Server
+}
+
+func NewSSEBroadcaster(allPublisher *es.Server, flagsPublisher *es.Server) *SSEBroadcaster {
+	return &SSEBroadcaster{allPublisher: allPublisher, flagsPublisher: flagsPublisher}
+}
+
+func (b *SSEBroadcaster) PublishAll(keys []string, event es.Event) {
+	b.allPublisher.Publish(keys, event)
+}
+
+func (b *SSEBroadcaster) PublishFlags(keys []string, event es.Event) {
+	b.flagsPublisher.Publish(keys, event)
+}
+
+// broadcastMessage is the wire format used by the pub-sub backed
+// broadcasters to carry an es.Event, plus the channel keys it was
+// published to, across relay replicas.
+type broadcastMessage struct {
+	Keys  []string `json:"keys"`
+	Event string   `json:"event"`
+	Id    string   `json:"id"`
+	Data  string   `json:"data"`
+}
+
+func marshalBroadcastMessage(keys []string, event es.Event) ([]byte, error) {
+	return json.Marshal(broadcastMessage{
+		Keys:  keys,
+		Event: event.Event(),
+		Id:    event.Id(),
+		Data:  event.Data(),
+	})
+}
+
+// RedisBroadcaster publishes to a Redis pub-sub channel so other relay
+// replicas subscribed to the same channel can re-publish the event to
+// their own local SSE clients.
+type RedisBroadcaster struct {
+	pool         *redis.Pool
+	allChannel   string
+	flagsChannel string
+}
+
+func NewRedisBroadcaster(pool *redis.Pool, allChannel string, flagsChannel string) *RedisBroadcaster {
+	return &RedisBroadcaster{pool: pool, allChannel: allChannel, flagsChannel: flagsChannel}
+}
+
+func (b *RedisBroadcaster) PublishAll(keys []string, event es.Event) {
+	b.publish(b.allChannel, keys, event)
+}
+
+func (b *RedisBroadcaster) PublishFlags(keys []string, event es.Event) {
+	b.publish(b.flagsChannel, keys, event)
+}
+
+func (b *RedisBroadcaster) publish(channel string, keys []string, event es.Event) {
+	payload, err := marshalBroadcastMessage(keys, event)
+	if err != nil {
+		Error.Printf("Error marshaling broadcast message: %s\n", err.Error())
+		return
+	}
+
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("PUBLISH", channel, payload); err != nil {
+		Error.Printf("Error publishing to Redis channel %s: %s\n", channel, err.Error())
+	}
+}
+
+// NatsBroadcaster publishes to a NATS subject, same purpose as
+// RedisBroadcaster but for operators who already run a NATS cluster.
+type NatsBroadcaster struct {
+	conn         *nats.Conn
+	allSubject   string
+	flagsSubject string
+}
+
+func NewNatsBroadcaster(conn *nats.Conn, allSubject string, flagsSubject string) *NatsBroadcaster {
+	return &NatsBroadcaster{conn: conn, allSubject: allSubject, flagsSubject: flagsSubject}
+}
+
+func (b *NatsBroadcaster) PublishAll(keys []string, event es.Event) {
+	b.publish(b.allSubject, keys, event)
+}
+
+func (b *NatsBroadcaster) PublishFlags(keys []string, event es.Event) {
+	b.publish(b.flagsSubject, keys, event)
+}
+
+func (b *NatsBroadcaster) publish(subject string, keys []string, event es.Event) {
+	payload, err := marshalBroadcastMessage(keys, event)
+	if err != nil {
+		Error.Printf("Error marshaling broadcast message: %s\n", err.Error())
+		return
+	}
+
+	if err := b.conn.Publish(subject, payload); err != nil {
+		Error.Printf("Error publishing to NATS subject %s: %s\n", subject, err.Error())
+	}
+}
+
+// CompositeBroadcaster tees every publish to a list of broadcasters, e.g.
+// to deliver to local SSE clients while also fanning out over Redis.
+type CompositeBroadcaster struct {
+	broadcasters []Broadcaster
+}
+
+func NewCompositeBroadcaster(broadcasters ...Broadcaster) *CompositeBroadcaster {
+	return &CompositeBroadcaster{broadcasters: broadcasters}
+}
+
+func (c *CompositeBroadcaster) PublishAll(keys []string, event es.Event) {
+	for _, b := range c.broadcasters {
+		b.PublishAll(keys, event)
+	}
+}
+
+func (c *CompositeBroadcaster) PublishFlags(keys []string, event es.Event) {
+	for _, b := range c.broadcasters {
+		b.PublishFlags(keys, event)
+	}
+}
+
+// remoteEvent reconstructs an es.Event received from another relay
+// replica over Redis/NATS pub-sub.
+type remoteEvent struct {
+	id    string
+	event string
+	data  string
+}
+
+func (e remoteEvent) Id() string {
+	return e.id
+}
+
+func (e remoteEvent) Event() string {
+	return e.event
+}
+
+func (e remoteEvent) Data() string {
+	return e.data
+}
+
+func (e remoteEvent) Comment() string {
+	return ""
+}
+
+func unmarshalBroadcastMessage(payload []byte) (keys []string, event es.Event, err error) {
+	var msg broadcastMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return nil, nil, err
+	}
+	return msg.Keys, remoteEvent{id: msg.Id, event: msg.Event, data: msg.Data}, nil
+}
+
+// RedisSubscriber is the receive side of RedisBroadcaster: it subscribes
+// to the same Redis channels a RedisBroadcaster publishes to, and
+// re-publishes every message it sees to this replica's own local SSE
+// servers. Pairing a RedisBroadcaster with a RedisSubscriber on every
+// replica is what actually fans flag updates out across a fleet, rather
+// than just writing to Redis.
+type RedisSubscriber struct {
+	pool           *redis.Pool
+	allChannel     string
+	flagsChannel   string
+	allPublisher   *es.Server
+	flagsPublisher *es.Server
+}
+
+// NewRedisSubscriber starts a background goroutine subscribed to
+// allChannel and flagsChannel; it runs until the connection fails.
+func NewRedisSubscriber(pool *redis.Pool, allChannel string, flagsChannel string, allPublisher *es.Server, flagsPublisher *es.Server) *RedisSubscriber {
+	s := &RedisSubscriber{
+		pool:           pool,
+		allChannel:     allChannel,
+		flagsChannel:   flagsChannel,
+		allPublisher:   allPublisher,
+		flagsPublisher: flagsPublisher,
+	}
+	go s.run()
+	return s
+}
+
+func (s *RedisSubscriber) run() {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	psc := redis.PubSubConn{Conn: conn}
+	if err := psc.Subscribe(s.allChannel, s.flagsChannel); err != nil {
+		Error.Printf("Error subscribing to Redis channels: %s\n", err.Error())
+		return
+	}
+	defer psc.Unsubscribe()
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			s.deliver(v.Channel, v.Data)
+		case error:
+			Error.Printf("Error receiving from Redis pub-sub: %s\n", v.Error())
+			return
+		}
+	}
+}
+
+func (s *RedisSubscriber) deliver(channel string, payload []byte) {
+	keys, event, err := unmarshalBroadcastMessage(payload)
+	if err != nil {
+		Error.Printf("Error unmarshaling broadcast message: %s\n", err.Error())
+		return
+	}
+
+	switch channel {
+	case s.allChannel:
+		s.allPublisher.Publish(keys, event)
+	case s.flagsChannel:
+		s.flagsPublisher.Publish(keys, event)
+	}
+}
+
+// NatsSubscriber is the receive side of NatsBroadcaster: it subscribes to
+// the same NATS subjects a NatsBroadcaster publishes to, and re-publishes
+// every message it sees to this replica's own local SSE servers.
+type NatsSubscriber struct {
+	conn *nats.Conn
+}
+
+// NewNatsSubscriber subscribes to allSubject and flagsSubject and
+// delivers every received message to the corresponding local publisher.
+func NewNatsSubscriber(conn *nats.Conn, allSubject string, flagsSubject string, allPublisher *es.Server, flagsPublisher *es.Server) (*NatsSubscriber, error) {
+	s := &NatsSubscriber{conn: conn}
+
+	if _, err := conn.Subscribe(allSubject, s.handler(allPublisher)); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Subscribe(flagsSubject, s.handler(flagsPublisher)); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *NatsSubscriber) handler(publisher *es.Server) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		keys, event, err := unmarshalBroadcastMessage(msg.Data)
+		if err != nil {
+			Error.Printf("Error unmarshaling broadcast message: %s\n", err.Error())
+			return
+		}
+		publisher.Publish(keys, event)
+	}
+}
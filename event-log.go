@@ -0,0 +1,114 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	es "github.com/launchdarkly/eventsource"
+)
+
+// DefaultEventLogSize and DefaultEventLogMaxAge bound how much recent
+// history an eventLog retains before falling back to telling a
+// reconnecting subscriber to take a full put instead of a replay.
+const (
+	DefaultEventLogSize   = 1000
+	DefaultEventLogMaxAge = 5 * time.Minute
+)
+
+// EventIDStore assigns monotonically increasing event IDs to a single
+// environment's stream of updates. It is persisted alongside the
+// environment's feature store (e.g. as a Redis counter) so that IDs keep
+// increasing across a relay restart instead of resetting to zero, which
+// would let a reconnecting client silently skip events.
+type EventIDStore interface {
+	NextID() (int64, error)
+}
+
+// inMemoryEventIDStore is the fallback used when no persistent
+// EventIDStore is configured. IDs still increase monotonically within the
+// life of the process, they just reset to zero on restart.
+type inMemoryEventIDStore struct {
+	counter int64
+}
+
+func (s *inMemoryEventIDStore) NextID() (int64, error) {
+	return atomic.AddInt64(&s.counter, 1), nil
+}
+
+type eventLogEntry struct {
+	id         int64
+	recordedAt time.Time
+	event      es.Event
+}
+
+// eventLog is a bounded ring of recently published patch/delete events for
+// one environment's stream, evicted by both size and age. It lets a
+// reconnecting SSE client that sends a Last-Event-ID catch up on exactly
+// what it missed instead of refetching the full flag set. record is
+// called synchronously from the update goroutine (Upsert/Delete) while
+// since is read concurrently from per-subscriber replay goroutines, so
+// entries is guarded by mu.
+type eventLog struct {
+	mu      sync.Mutex
+	entries []eventLogEntry
+	maxSize int
+	maxAge  time.Duration
+}
+
+func newEventLog(maxSize int, maxAge time.Duration) *eventLog {
+	if maxSize <= 0 {
+		maxSize = DefaultEventLogSize
+	}
+	if maxAge <= 0 {
+		maxAge = DefaultEventLogMaxAge
+	}
+	return &eventLog{maxSize: maxSize, maxAge: maxAge}
+}
+
+func (l *eventLog) record(id int64, event es.Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, eventLogEntry{id: id, recordedAt: time.Now(), event: event})
+	l.evict()
+}
+
+// evict assumes mu is already held.
+func (l *eventLog) evict() {
+	if len(l.entries) > l.maxSize {
+		l.entries = l.entries[len(l.entries)-l.maxSize:]
+	}
+
+	cutoff := time.Now().Add(-l.maxAge)
+	i := 0
+	for i < len(l.entries) && l.entries[i].recordedAt.Before(cutoff) {
+		i++
+	}
+	if i > 0 {
+		l.entries = l.entries[i:]
+	}
+}
+
+// since returns every event recorded with an id greater than afterID, in
+// order. ok is false when afterID is older than anything retained (or the
+// log is empty, whatever afterID is), meaning the caller must fall back to
+// a full put instead.
+func (l *eventLog) since(afterID int64) (events []es.Event, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.entries) == 0 {
+		return nil, false
+	}
+
+	if afterID < l.entries[0].id-1 {
+		return nil, false
+	}
+
+	for _, e := range l.entries {
+		if e.id > afterID {
+			events = append(events, e.event)
+		}
+	}
+	return events, true
+}
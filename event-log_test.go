@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	es "github.com/launchdarkly/eventsource"
+)
+
+type testEvent string
+
+func (e testEvent) Id() string      { return string(e) }
+func (e testEvent) Event() string   { return "patch" }
+func (e testEvent) Data() string    { return string(e) }
+func (e testEvent) Comment() string { return "" }
+
+func TestEventLogSinceReturnsEventsAfterID(t *testing.T) {
+	l := newEventLog(10, time.Minute)
+	l.record(1, testEvent("a"))
+	l.record(2, testEvent("b"))
+	l.record(3, testEvent("c"))
+
+	events, ok := l.since(1)
+	if !ok {
+		t.Fatalf("since(1) ok = false, want true")
+	}
+	if len(events) != 2 || events[0].(testEvent) != "b" || events[1].(testEvent) != "c" {
+		t.Fatalf("since(1) = %v, want [b c]", events)
+	}
+}
+
+func TestEventLogSinceEmptyLog(t *testing.T) {
+	l := newEventLog(10, time.Minute)
+	if _, ok := l.since(0); ok {
+		t.Fatalf("since() on empty log ok = true, want false")
+	}
+}
+
+func TestEventLogSinceTooOldFallsBackToFullPut(t *testing.T) {
+	l := newEventLog(2, time.Minute)
+	l.record(1, testEvent("a"))
+	l.record(2, testEvent("b"))
+	l.record(3, testEvent("c")) // evicts id 1
+
+	if _, ok := l.since(0); ok {
+		t.Fatalf("since(0) ok = true, want false once id 1 has been evicted")
+	}
+}
+
+func TestEventLogRecordEvictsBySize(t *testing.T) {
+	l := newEventLog(2, time.Minute)
+	l.record(1, testEvent("a"))
+	l.record(2, testEvent("b"))
+	l.record(3, testEvent("c"))
+
+	events, ok := l.since(1)
+	if !ok || len(events) != 2 {
+		t.Fatalf("since(1) = %v, %v; want 2 events retained", events, ok)
+	}
+	if len(l.entries) != 2 || l.entries[0].id != 2 {
+		t.Fatalf("entries = %v, want ids [2 3] once id 1 has been evicted", l.entries)
+	}
+}
+
+func TestEventLogConcurrentRecordAndSince(t *testing.T) {
+	l := newEventLog(100, time.Minute)
+	done := make(chan struct{})
+
+	go func() {
+		for i := int64(1); i <= 50; i++ {
+			l.record(i, testEvent("x"))
+		}
+		close(done)
+	}()
+
+	for i := 0; i < 50; i++ {
+		l.since(0)
+	}
+	<-done
+}
+
+var _ es.Event = testEvent("")
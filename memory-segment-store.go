@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sync"
+
+	ld "gopkg.in/launchdarkly/go-client.v2"
+)
+
+// memorySegmentStore is a minimal in-memory SegmentStore. It is the
+// default used by NewSSERelayFeatureStore when no segment store is
+// supplied, so that an environment which doesn't care about segments
+// doesn't have to wire one up (and so the relay store never calls a
+// method on a nil SegmentStore).
+type memorySegmentStore struct {
+	mu          sync.RWMutex
+	segments    map[string]*ld.Segment
+	initialized bool
+}
+
+func newMemorySegmentStore() *memorySegmentStore {
+	return &memorySegmentStore{segments: make(map[string]*ld.Segment)}
+}
+
+func (s *memorySegmentStore) Get(key string) (*ld.Segment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.segments[key], nil
+}
+
+func (s *memorySegmentStore) All() (map[string]*ld.Segment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := make(map[string]*ld.Segment, len(s.segments))
+	for key, segment := range s.segments {
+		out[key] = segment
+	}
+	return out, nil
+}
+
+func (s *memorySegmentStore) Init(segments map[string]*ld.Segment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.segments = make(map[string]*ld.Segment, len(segments))
+	for key, segment := range segments {
+		s.segments[key] = segment
+	}
+	s.initialized = true
+	return nil
+}
+
+// Delete removes a segment, but only if version is newer than the version
+// currently stored, so an out-of-order delete can't clobber a newer
+// update that already arrived.
+func (s *memorySegmentStore) Delete(key string, version int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.segments[key]; ok && existing.Version >= version {
+		return nil
+	}
+	delete(s.segments, key)
+	return nil
+}
+
+// Upsert stores segment, but only if its version is newer than the
+// version currently stored, so an out-of-order update can't clobber newer
+// data with stale data.
+func (s *memorySegmentStore) Upsert(key string, segment ld.Segment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.segments[key]; ok && existing.Version >= segment.Version {
+		return nil
+	}
+	s.segments[key] = &segment
+	return nil
+}
+
+func (s *memorySegmentStore) Initialized() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.initialized
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+type metricsKey struct {
+	apiKey string
+	stream string
+}
+
+// Metrics tracks relay backpressure stats per environment (SDK key) and
+// per stream ("all" or "flags"): how many events a subscriber's queue has
+// had to drop because it was full, and how deep that queue currently is.
+// Both are exposed in Prometheus text-exposition format via Handler, so
+// operators can see which environment/stream is falling behind real-time
+// updates from LaunchDarkly.
+type Metrics struct {
+	mu            sync.Mutex
+	eventsDropped map[metricsKey]int64
+	queueDepth    map[metricsKey]int
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		eventsDropped: make(map[metricsKey]int64),
+		queueDepth:    make(map[metricsKey]int),
+	}
+}
+
+func (m *Metrics) IncrDropped(apiKey string, stream string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.eventsDropped[metricsKey{apiKey, stream}]++
+}
+
+func (m *Metrics) SetQueueDepth(apiKey string, stream string, depth int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queueDepth[metricsKey{apiKey, stream}] = depth
+}
+
+// WriteTo renders the current metrics in Prometheus text-exposition
+// format.
+func (m *Metrics) WriteTo(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	seen := make(map[metricsKey]bool)
+	for k := range m.eventsDropped {
+		seen[k] = true
+	}
+	for k := range m.queueDepth {
+		seen[k] = true
+	}
+	sorted := make([]metricsKey, 0, len(seen))
+	for k := range seen {
+		sorted = append(sorted, k)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].apiKey != sorted[j].apiKey {
+			return sorted[i].apiKey < sorted[j].apiKey
+		}
+		return sorted[i].stream < sorted[j].stream
+	})
+
+	fmt.Fprintln(w, "# HELP relay_events_dropped_total Events dropped from a subscriber queue because it was full")
+	fmt.Fprintln(w, "# TYPE relay_events_dropped_total counter")
+	for _, key := range sorted {
+		fmt.Fprintf(w, "relay_events_dropped_total{env=%q,stream=%q} %d\n", key.apiKey, key.stream, m.eventsDropped[key])
+	}
+
+	fmt.Fprintln(w, "# HELP relay_subscriber_queue_depth Current depth of a subscriber's event queue")
+	fmt.Fprintln(w, "# TYPE relay_subscriber_queue_depth gauge")
+	for _, key := range sorted {
+		fmt.Fprintf(w, "relay_subscriber_queue_depth{env=%q,stream=%q} %d\n", key.apiKey, key.stream, m.queueDepth[key])
+	}
+
+	return nil
+}
+
+// Handler serves the metrics in Prometheus text-exposition format at a
+// /metrics endpoint.
+func (m *Metrics) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.WriteTo(w)
+	}
+}
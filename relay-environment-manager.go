@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	es "github.com/launchdarkly/eventsource"
+	ld "gopkg.in/launchdarkly/go-client.v2"
+)
+
+// RelayEnvironmentManager owns one SSERelayFeatureStore per LaunchDarkly
+// environment (SDK key) so that a single relay process can proxy several
+// environments at once. Each environment keeps its own base feature store
+// (for instance a Redis store configured with a distinct key prefix), so
+// environments never share flag state.
+type RelayEnvironmentManager struct {
+	mu     sync.RWMutex
+	stores map[string]*SSERelayFeatureStore
+}
+
+// NewRelayEnvironmentManager creates an empty manager. Environments are
+// added to it with AddEnvironment as the relay is configured.
+func NewRelayEnvironmentManager() *RelayEnvironmentManager {
+	return &RelayEnvironmentManager{
+		stores: make(map[string]*SSERelayFeatureStore),
+	}
+}
+
+// AddEnvironment registers a new environment under its SDK key and returns
+// the SSERelayFeatureStore created for it. allPublisher and flagsPublisher
+// are typically shared across environments; SSERelayFeatureStore already
+// registers itself with each publisher under its own apiKey channel, so
+// subscribers are multiplexed by the publisher without further changes
+// here.
+func (m *RelayEnvironmentManager) AddEnvironment(apiKey string, allPublisher *es.Server, flagsPublisher *es.Server, baseFeatureStore ld.FeatureStore, baseSegmentStore SegmentStore, idStore EventIDStore, broadcaster Broadcaster, metrics *Metrics, webhooks *WebhookDispatcher, heartbeatInterval int) *SSERelayFeatureStore {
+	relayStore := NewSSERelayFeatureStore(apiKey, allPublisher, flagsPublisher, baseFeatureStore, baseSegmentStore, idStore, broadcaster, metrics, webhooks, heartbeatInterval)
+
+	m.mu.Lock()
+	m.stores[apiKey] = relayStore
+	m.mu.Unlock()
+
+	return relayStore
+}
+
+// RemoveEnvironment drops an environment's store from the manager. It does
+// not unregister it from the publishers; callers that need to tear down a
+// live environment should stop routing new connections to it first.
+func (m *RelayEnvironmentManager) RemoveEnvironment(apiKey string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.stores, apiKey)
+}
+
+// StoreForApiKey returns the environment registered under the given SDK
+// key, if any.
+func (m *RelayEnvironmentManager) StoreForApiKey(apiKey string) (*SSERelayFeatureStore, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	store, ok := m.stores[apiKey]
+	return store, ok
+}
+
+// StoreForAuthHeader resolves the environment whose SDK key is carried in
+// an incoming "Authorization" header, as sent by an SSE subscriber
+// connecting to /all or /flags. It is the dispatch point HTTP handlers
+// should use to route a subscriber to the right environment.
+func (m *RelayEnvironmentManager) StoreForAuthHeader(authHeader string) (*SSERelayFeatureStore, bool) {
+	return m.StoreForApiKey(strings.TrimSpace(authHeader))
+}
+
+// ApiKeys returns the SDK keys of every environment currently registered.
+func (m *RelayEnvironmentManager) ApiKeys() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	keys := make([]string, 0, len(m.stores))
+	for k := range m.stores {
+		keys = append(keys, k)
+	}
+	return keys
+}
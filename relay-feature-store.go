@@ -2,15 +2,38 @@ package main
 
 import (
 	"encoding/json"
+	"strconv"
+	"sync/atomic"
+	"time"
+
 	es "github.com/launchdarkly/eventsource"
 	ld "gopkg.in/launchdarkly/go-client.v2"
-	"time"
 )
 
+// SegmentStore is the v3-style data store interface for user segments,
+// mirroring the shape of ld.FeatureStore. A relay feature store wraps one
+// of these alongside its flag store so that segments can be published and
+// replayed the same way flags are.
+type SegmentStore interface {
+	Get(key string) (*ld.Segment, error)
+	All() (map[string]*ld.Segment, error)
+	Init(segments map[string]*ld.Segment) error
+	Delete(key string, version int) error
+	Upsert(key string, s ld.Segment) error
+	Initialized() bool
+}
+
 type SSERelayFeatureStore struct {
 	store          ld.FeatureStore
+	segmentStore   SegmentStore
 	allPublisher   *es.Server
 	flagsPublisher *es.Server
+	broadcaster    Broadcaster
+	idStore        EventIDStore
+	lastEventID    int64 // atomic; last ID handed out by idStore
+	allEventLog    *eventLog
+	flagsEventLog  *eventLog
+	webhooks       *WebhookDispatcher
 	apiKey         string
 }
 
@@ -21,12 +44,51 @@ type flagsRepository struct {
 	relayStore *SSERelayFeatureStore
 }
 
-func NewSSERelayFeatureStore(apiKey string, allPublisher *es.Server, flagsPublisher *es.Server, baseFeatureStore ld.FeatureStore, heartbeatInterval int) *SSERelayFeatureStore {
+// NewSSERelayFeatureStore wires up a relay feature store for a single
+// environment. If broadcaster is nil, updates are delivered directly to
+// allPublisher/flagsPublisher through a QueuedBroadcaster, so that a slow
+// or stalled environment can't stall delivery to every other environment
+// by default; because the underlying es.Server fans a single Publish call
+// out to every locally-connected client of an environment synchronously,
+// this does not by itself isolate one slow client from other clients of
+// the *same* environment — pass a RedisBroadcaster, NatsBroadcaster or
+// CompositeBroadcaster (optionally wrapped in NewQueuedBroadcaster
+// yourself) to fan updates out across relay replicas as well. metrics, if
+// non-nil, records the resulting per-environment, per-stream queue depth
+// and drop counts; it is ignored when broadcaster is supplied explicitly.
+// If idStore is nil, event IDs are assigned from an in-process counter
+// that resets on restart; pass a store backed by Redis (or similar) to
+// keep IDs durable across restarts so reconnecting subscribers can replay
+// from their Last-Event-ID. If baseSegmentStore is nil, an in-memory store
+// is used, so an environment that doesn't care about segments doesn't
+// have to wire one up. If webhooks is nil, no webhook notifications are
+// sent.
+func NewSSERelayFeatureStore(apiKey string, allPublisher *es.Server, flagsPublisher *es.Server, baseFeatureStore ld.FeatureStore, baseSegmentStore SegmentStore, idStore EventIDStore, broadcaster Broadcaster, metrics *Metrics, webhooks *WebhookDispatcher, heartbeatInterval int) *SSERelayFeatureStore {
+	if broadcaster == nil {
+		if metrics == nil {
+			metrics = NewMetrics()
+		}
+		broadcaster = NewQueuedBroadcaster(NewSSEBroadcaster(allPublisher, flagsPublisher), DefaultSubscriberQueueSize, metrics)
+	}
+	if idStore == nil {
+		idStore = &inMemoryEventIDStore{}
+	}
+	if baseSegmentStore == nil {
+		baseSegmentStore = newMemorySegmentStore()
+		baseSegmentStore.Init(map[string]*ld.Segment{})
+	}
+
 	relayStore := &SSERelayFeatureStore{
 		store:          baseFeatureStore,
+		segmentStore:   baseSegmentStore,
 		apiKey:         apiKey,
 		allPublisher:   allPublisher,
 		flagsPublisher: flagsPublisher,
+		broadcaster:    broadcaster,
+		idStore:        idStore,
+		allEventLog:    newEventLog(DefaultEventLogSize, DefaultEventLogMaxAge),
+		flagsEventLog:  newEventLog(DefaultEventLogSize, DefaultEventLogMaxAge),
+		webhooks:       webhooks,
 	}
 
 	allPublisher.Register(apiKey, allRepository{relayStore})
@@ -49,9 +111,47 @@ func (relay *SSERelayFeatureStore) keys() []string {
 	return []string{relay.apiKey}
 }
 
+// nextEventID assigns a new, persisted event ID and remembers it as the
+// most recently assigned one. It returns both the raw id (for recording
+// into an eventLog) and its string form (for the SSE event itself);
+// callers must use the returned id rather than re-reading lastEventID, since
+// a concurrent nextEventID call on the flags/segments sibling stream can
+// have advanced it in the meantime.
+func (relay *SSERelayFeatureStore) nextEventID() (int64, string, error) {
+	id, err := relay.idStore.NextID()
+	if err != nil {
+		return 0, "", err
+	}
+	atomic.StoreInt64(&relay.lastEventID, id)
+	return id, strconv.FormatInt(id, 10), nil
+}
+
+// currentEventID returns the most recently assigned event ID without
+// allocating a new one, for use on put events: a put reflects the state as
+// of the last patch/delete, so it carries that same ID.
+func (relay *SSERelayFeatureStore) currentEventID() string {
+	return strconv.FormatInt(atomic.LoadInt64(&relay.lastEventID), 10)
+}
+
+// dispatchWebhook notifies the configured webhook endpoints, if any, of a
+// flag change. It is a no-op when no WebhookDispatcher was configured.
+func (relay *SSERelayFeatureStore) dispatchWebhook(key string, oldFlag *ld.FeatureFlag, newFlag *ld.FeatureFlag, version int) {
+	if relay.webhooks == nil {
+		return
+	}
+
+	relay.webhooks.Dispatch(FlagDiff{
+		Environment: relay.apiKey,
+		Key:         key,
+		Old:         oldFlag,
+		New:         newFlag,
+		Version:     version,
+	})
+}
+
 func (relay *SSERelayFeatureStore) heartbeat() {
-	relay.allPublisher.Publish(relay.keys(), heartbeatEvent("hb"))
-	relay.flagsPublisher.Publish(relay.keys(), heartbeatEvent("hb"))
+	relay.broadcaster.PublishAll(relay.keys(), heartbeatEvent("hb"))
+	relay.broadcaster.PublishFlags(relay.keys(), heartbeatEvent("hb"))
 }
 
 func (relay *SSERelayFeatureStore) Get(key string) (*ld.FeatureFlag, error) {
@@ -62,6 +162,10 @@ func (relay *SSERelayFeatureStore) All() (map[string]*ld.FeatureFlag, error) {
 	return relay.store.All()
 }
 
+func (relay *SSERelayFeatureStore) AllSegments() (map[string]*ld.Segment, error) {
+	return relay.segmentStore.All()
+}
+
 func (relay *SSERelayFeatureStore) Init(flags map[string]*ld.FeatureFlag) error {
 	err := relay.store.Init(flags)
 
@@ -69,25 +173,73 @@ func (relay *SSERelayFeatureStore) Init(flags map[string]*ld.FeatureFlag) error
 		return err
 	}
 
-	relay.allPublisher.Publish(relay.keys(), makePutEvent(flags))
-	relay.flagsPublisher.Publish(relay.keys(), makeFlagsPutEvent(flags))
+	segments, err := relay.segmentStore.All()
+
+	if err != nil {
+		return err
+	}
+
+	relay.broadcaster.PublishAll(relay.keys(), makePutEvent(flags, segments, relay.currentEventID()))
+	relay.broadcaster.PublishFlags(relay.keys(), makeFlagsPutEvent(flags, relay.currentEventID()))
+
+	for key, flag := range flags {
+		relay.dispatchWebhook(key, nil, flag, flag.Version)
+	}
+
+	return nil
+}
+
+// InitSegments (re)initializes the segment store, independently of the
+// flag store, and republishes a full put event on the all-data stream so
+// subscribers pick up the new segment set alongside the current flags.
+func (relay *SSERelayFeatureStore) InitSegments(segments map[string]*ld.Segment) error {
+	err := relay.segmentStore.Init(segments)
+
+	if err != nil {
+		return err
+	}
+
+	flags, err := relay.store.All()
+
+	if err != nil {
+		return err
+	}
+
+	relay.broadcaster.PublishAll(relay.keys(), makePutEvent(flags, segments, relay.currentEventID()))
 
 	return nil
 }
 
 func (relay *SSERelayFeatureStore) Delete(key string, version int) error {
+	oldFlag, _ := relay.store.Get(key) // best-effort, only used for the webhook diff
+
 	err := relay.store.Delete(key, version)
 	if err != nil {
 		return err
 	}
 
-	relay.allPublisher.Publish(relay.keys(), makeDeleteEvent(key, version))
-	relay.flagsPublisher.Publish(relay.keys(), makeFlagsDeleteEvent(key, version))
+	eventID, id, err := relay.nextEventID()
+	if err != nil {
+		return err
+	}
+
+	allEvent := makeDeleteEvent(key, version, id)
+	flagsEvent := makeFlagsDeleteEvent(key, version, id)
+
+	relay.allEventLog.record(eventID, allEvent)
+	relay.flagsEventLog.record(eventID, flagsEvent)
+
+	relay.broadcaster.PublishAll(relay.keys(), allEvent)
+	relay.broadcaster.PublishFlags(relay.keys(), flagsEvent)
+
+	relay.dispatchWebhook(key, oldFlag, nil, version)
 
 	return nil
 }
 
 func (relay *SSERelayFeatureStore) Upsert(key string, f ld.FeatureFlag) error {
+	oldFlag, _ := relay.store.Get(key) // best-effort, only used for the webhook diff
+
 	err := relay.store.Upsert(key, f)
 
 	if err != nil {
@@ -101,15 +253,95 @@ func (relay *SSERelayFeatureStore) Upsert(key string, f ld.FeatureFlag) error {
 	}
 
 	if flag != nil {
-		relay.allPublisher.Publish(relay.keys(), makeUpsertEvent(*flag))
-		relay.flagsPublisher.Publish(relay.keys(), makeFlagsUpsertEvent(*flag))
+		eventID, id, err := relay.nextEventID()
+		if err != nil {
+			return err
+		}
+
+		allEvent := makeUpsertEvent(*flag, id)
+		flagsEvent := makeFlagsUpsertEvent(*flag, id)
+
+		relay.allEventLog.record(eventID, allEvent)
+		relay.flagsEventLog.record(eventID, flagsEvent)
+
+		relay.broadcaster.PublishAll(relay.keys(), allEvent)
+		relay.broadcaster.PublishFlags(relay.keys(), flagsEvent)
+
+		relay.dispatchWebhook(key, oldFlag, flag, flag.Version)
+	}
+
+	return nil
+}
+
+// UpsertSegment updates or inserts a segment and publishes a patch event
+// with a "/segments/<key>" path on the all-data stream. Segments are not
+// part of the flags-only stream.
+func (relay *SSERelayFeatureStore) UpsertSegment(key string, s ld.Segment) error {
+	err := relay.segmentStore.Upsert(key, s)
+
+	if err != nil {
+		return err
+	}
+
+	segment, err := relay.segmentStore.Get(key)
+
+	if err != nil {
+		return err
+	}
+
+	if segment != nil {
+		eventID, id, err := relay.nextEventID()
+		if err != nil {
+			return err
+		}
+
+		event := makeSegmentUpsertEvent(*segment, id)
+		relay.allEventLog.record(eventID, event)
+		relay.broadcaster.PublishAll(relay.keys(), event)
+	}
+
+	return nil
+}
+
+// DeleteSegment deletes a segment and publishes a delete event with a
+// "/segments/<key>" path on the all-data stream.
+func (relay *SSERelayFeatureStore) DeleteSegment(key string, version int) error {
+	err := relay.segmentStore.Delete(key, version)
+	if err != nil {
+		return err
+	}
+
+	eventID, id, err := relay.nextEventID()
+	if err != nil {
+		return err
 	}
 
+	event := makeSegmentDeleteEvent(key, version, id)
+	relay.allEventLog.record(eventID, event)
+	relay.broadcaster.PublishAll(relay.keys(), event)
+
 	return nil
 }
 
 func (relay *SSERelayFeatureStore) Initialized() bool {
-	return relay.store.Initialized()
+	return relay.store.Initialized() && relay.segmentStore.Initialized()
+}
+
+// replaySince tries to satisfy a reconnecting subscriber's Last-Event-ID
+// from the given log's retained history. ok is false if the log can't
+// cover the gap (too old, or log is empty), meaning the caller should fall
+// back to sending a full put.
+func replaySince(log *eventLog, lastEventID string) (events []es.Event, ok bool) {
+	if lastEventID == "" {
+		return nil, false
+	}
+
+	afterID, err := strconv.ParseInt(lastEventID, 10, 64)
+	if err != nil {
+		return nil, false
+	}
+
+	return log.since(afterID)
 }
 
 // Allows the feature store to act as an SSE repository (to send bootstrap events)
@@ -117,14 +349,23 @@ func (r flagsRepository) Replay(channel, id string) (out chan es.Event) {
 	out = make(chan es.Event)
 	go func() {
 		defer close(out)
-		if r.relayStore.Initialized() {
-			flags, err := r.relayStore.All()
+		if !r.relayStore.Initialized() {
+			return
+		}
 
-			if err != nil {
-				Error.Printf("Error getting all flags: %s\n", err.Error())
-			} else {
-				out <- makeFlagsPutEvent(flags)
+		if events, ok := replaySince(r.relayStore.flagsEventLog, id); ok {
+			for _, event := range events {
+				out <- event
 			}
+			return
+		}
+
+		flags, err := r.relayStore.All()
+
+		if err != nil {
+			Error.Printf("Error getting all flags: %s\n", err.Error())
+		} else {
+			out <- makeFlagsPutEvent(flags, r.relayStore.currentEventID())
 		}
 	}()
 	return
@@ -134,30 +375,56 @@ func (r allRepository) Replay(channel, id string) (out chan es.Event) {
 	out = make(chan es.Event)
 	go func() {
 		defer close(out)
-		if r.relayStore.Initialized() {
-			flags, err := r.relayStore.All()
+		if !r.relayStore.Initialized() {
+			return
+		}
 
-			if err != nil {
-				Error.Printf("Error getting all flags: %s\n", err.Error())
-			} else {
-				out <- makePutEvent(flags)
+		if events, ok := replaySince(r.relayStore.allEventLog, id); ok {
+			for _, event := range events {
+				out <- event
 			}
+			return
+		}
+
+		flags, err := r.relayStore.All()
+
+		if err != nil {
+			Error.Printf("Error getting all flags: %s\n", err.Error())
+			return
+		}
+
+		segments, err := r.relayStore.AllSegments()
+
+		if err != nil {
+			Error.Printf("Error getting all segments: %s\n", err.Error())
+			return
 		}
+
+		out <- makePutEvent(flags, segments, r.relayStore.currentEventID())
 	}()
 	return
 }
 
-type flagsPutEvent map[string]*ld.FeatureFlag
-type allPutEvent map[string]map[string]interface{}
+type flagsPutEvent struct {
+	id    string
+	flags map[string]*ld.FeatureFlag
+}
+
+type allPutEvent struct {
+	id   string
+	data map[string]map[string]interface{}
+}
 
 type deleteEvent struct {
 	Path    string `json:"path"`
 	Version int    `json:"version"`
+	id      string
 }
 
 type upsertEvent struct {
-	Path string         `json:"path"`
-	D    ld.FeatureFlag `json:"data"`
+	Path string      `json:"path"`
+	D    interface{} `json:"data"`
+	id   string
 }
 
 type heartbeatEvent string
@@ -179,7 +446,7 @@ func (h heartbeatEvent) Comment() string {
 }
 
 func (t flagsPutEvent) Id() string {
-	return ""
+	return t.id
 }
 
 func (t flagsPutEvent) Event() string {
@@ -187,7 +454,7 @@ func (t flagsPutEvent) Event() string {
 }
 
 func (t flagsPutEvent) Data() string {
-	data, _ := json.Marshal(t)
+	data, _ := json.Marshal(t.flags)
 
 	return string(data)
 }
@@ -197,7 +464,7 @@ func (t flagsPutEvent) Comment() string {
 }
 
 func (t allPutEvent) Id() string {
-	return ""
+	return t.id
 }
 
 func (t allPutEvent) Event() string {
@@ -205,7 +472,7 @@ func (t allPutEvent) Event() string {
 }
 
 func (t allPutEvent) Data() string {
-	data, _ := json.Marshal(t)
+	data, _ := json.Marshal(t.data)
 
 	return string(data)
 }
@@ -215,7 +482,7 @@ func (t allPutEvent) Comment() string {
 }
 
 func (t upsertEvent) Id() string {
-	return ""
+	return t.id
 }
 
 func (t upsertEvent) Event() string {
@@ -233,7 +500,7 @@ func (t upsertEvent) Comment() string {
 }
 
 func (t deleteEvent) Id() string {
-	return ""
+	return t.id
 }
 
 func (t deleteEvent) Event() string {
@@ -250,43 +517,68 @@ func (t deleteEvent) Comment() string {
 	return ""
 }
 
-func makeUpsertEvent(f ld.FeatureFlag) es.Event {
+func makeUpsertEvent(f ld.FeatureFlag, id string) es.Event {
 	return upsertEvent{
 		Path: "/" + "flags" + "/" + f.Key,
 		D:    f,
+		id:   id,
 	}
 }
 
-func makeFlagsUpsertEvent(f ld.FeatureFlag) es.Event {
+func makeFlagsUpsertEvent(f ld.FeatureFlag, id string) es.Event {
 	return upsertEvent{
 		Path: "/" + f.Key,
 		D:    f,
+		id:   id,
 	}
 }
 
-func makeDeleteEvent(key string, version int) es.Event {
+func makeDeleteEvent(key string, version int, id string) es.Event {
 	return deleteEvent{
 		Path:    "/" + "flags" + "/" + key,
 		Version: version,
+		id:      id,
 	}
 }
 
-func makeFlagsDeleteEvent(key string, version int) es.Event {
+func makeFlagsDeleteEvent(key string, version int, id string) es.Event {
 	return deleteEvent{
 		Path:    "/" + key,
 		Version: version,
+		id:      id,
+	}
+}
+
+func makeSegmentUpsertEvent(s ld.Segment, id string) es.Event {
+	return upsertEvent{
+		Path: "/" + "segments" + "/" + s.Key,
+		D:    s,
+		id:   id,
 	}
 }
 
-func makePutEvent(flags map[string]*ld.FeatureFlag) es.Event {
-	allData := make(map[string]map[string]interface{})
+func makeSegmentDeleteEvent(key string, version int, id string) es.Event {
+	return deleteEvent{
+		Path:    "/" + "segments" + "/" + key,
+		Version: version,
+		id:      id,
+	}
+}
+
+func makePutEvent(flags map[string]*ld.FeatureFlag, segments map[string]*ld.Segment, id string) es.Event {
+	allData := map[string]map[string]interface{}{
+		"flags":    make(map[string]interface{}),
+		"segments": make(map[string]interface{}),
+	}
 	for key, flag := range flags {
 		allData["flags"][key] = flag
 	}
-	allData["segments"] = make(map[string]interface{})
-	return allPutEvent(allData)
+	for key, segment := range segments {
+		allData["segments"][key] = segment
+	}
+	return allPutEvent{id: id, data: allData}
 }
 
-func makeFlagsPutEvent(flags map[string]*ld.FeatureFlag) es.Event {
-	return flagsPutEvent(flags)
+func makeFlagsPutEvent(flags map[string]*ld.FeatureFlag, id string) es.Event {
+	return flagsPutEvent{id: id, flags: flags}
 }
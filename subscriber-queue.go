@@ -0,0 +1,172 @@
+package main
+
+import (
+	"sync"
+
+	es "github.com/launchdarkly/eventsource"
+)
+
+// DefaultSubscriberQueueSize is the number of events buffered per
+// environment, per stream, before the oldest event is dropped to make
+// room for a new one.
+const DefaultSubscriberQueueSize = 1024
+
+// ringBuffer is a fixed-size FIFO that overwrites its oldest entry instead
+// of blocking once full.
+type ringBuffer struct {
+	mu    sync.Mutex
+	items []interface{}
+	head  int
+	count int
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{items: make([]interface{}, size)}
+}
+
+// push adds an item, reporting whether it overwrote an existing one.
+func (r *ringBuffer) push(item interface{}) (dropped bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	size := len(r.items)
+	if r.count == size {
+		r.head = (r.head + 1) % size
+		r.count--
+		dropped = true
+	}
+
+	idx := (r.head + r.count) % size
+	r.items[idx] = item
+	r.count++
+	return dropped
+}
+
+func (r *ringBuffer) pop() (interface{}, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.count == 0 {
+		return nil, false
+	}
+
+	item := r.items[r.head]
+	r.head = (r.head + 1) % len(r.items)
+	r.count--
+	return item, true
+}
+
+func (r *ringBuffer) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.count
+}
+
+type queuedEvent struct {
+	keys  []string
+	event es.Event
+}
+
+// subscriberQueue decouples a single environment's publish path from
+// delivery: Publish calls enqueue into a bounded ring buffer and return
+// immediately, while a dedicated goroutine drains the buffer and hands
+// events to the underlying broadcaster. A slow or stalled delivery path
+// for one environment can no longer stall updates to every other
+// environment.
+type subscriberQueue struct {
+	apiKey  string
+	stream  string // "all" or "flags", so the two queues for the same environment get distinct metrics series
+	buf     *ringBuffer
+	wake    chan struct{}
+	metrics *Metrics
+	deliver func(keys []string, event es.Event)
+}
+
+func newSubscriberQueue(apiKey string, stream string, size int, metrics *Metrics, deliver func(keys []string, event es.Event)) *subscriberQueue {
+	q := &subscriberQueue{
+		apiKey:  apiKey,
+		stream:  stream,
+		buf:     newRingBuffer(size),
+		wake:    make(chan struct{}, 1),
+		metrics: metrics,
+		deliver: deliver,
+	}
+	go q.run()
+	return q
+}
+
+func (q *subscriberQueue) enqueue(keys []string, event es.Event) {
+	if q.buf.push(queuedEvent{keys: keys, event: event}) {
+		q.metrics.IncrDropped(q.apiKey, q.stream)
+	}
+	q.metrics.SetQueueDepth(q.apiKey, q.stream, q.buf.len())
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *subscriberQueue) run() {
+	for range q.wake {
+		for {
+			item, ok := q.buf.pop()
+			if !ok {
+				break
+			}
+			q.metrics.SetQueueDepth(q.apiKey, q.stream, q.buf.len())
+			qe := item.(queuedEvent)
+			q.deliver(qe.keys, qe.event)
+		}
+	}
+}
+
+// QueuedBroadcaster wraps another Broadcaster with a bounded, drop-oldest
+// per-environment, per-stream queue in front of it, so that a slow
+// delivery path for one environment's subscribers cannot stall delivery
+// to any other environment.
+type QueuedBroadcaster struct {
+	mu          sync.Mutex
+	underlying  Broadcaster
+	queueSize   int
+	metrics     *Metrics
+	allQueues   map[string]*subscriberQueue
+	flagsQueues map[string]*subscriberQueue
+}
+
+func NewQueuedBroadcaster(underlying Broadcaster, queueSize int, metrics *Metrics) *QueuedBroadcaster {
+	if queueSize <= 0 {
+		queueSize = DefaultSubscriberQueueSize
+	}
+	return &QueuedBroadcaster{
+		underlying:  underlying,
+		queueSize:   queueSize,
+		metrics:     metrics,
+		allQueues:   make(map[string]*subscriberQueue),
+		flagsQueues: make(map[string]*subscriberQueue),
+	}
+}
+
+func (b *QueuedBroadcaster) PublishAll(keys []string, event es.Event) {
+	for _, key := range keys {
+		b.queueFor(b.allQueues, key, "all", b.underlying.PublishAll).enqueue([]string{key}, event)
+	}
+}
+
+func (b *QueuedBroadcaster) PublishFlags(keys []string, event es.Event) {
+	for _, key := range keys {
+		b.queueFor(b.flagsQueues, key, "flags", b.underlying.PublishFlags).enqueue([]string{key}, event)
+	}
+}
+
+func (b *QueuedBroadcaster) queueFor(queues map[string]*subscriberQueue, apiKey string, stream string, deliver func(keys []string, event es.Event)) *subscriberQueue {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	q, ok := queues[apiKey]
+	if !ok {
+		q = newSubscriberQueue(apiKey, stream, b.queueSize, b.metrics, deliver)
+		queues[apiKey] = q
+	}
+	return q
+}
@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestRingBufferFIFO(t *testing.T) {
+	r := newRingBuffer(3)
+
+	if dropped := r.push(1); dropped {
+		t.Fatalf("push into empty buffer reported a drop")
+	}
+	r.push(2)
+	r.push(3)
+
+	if got, want := r.len(), 3; got != want {
+		t.Fatalf("len() = %d, want %d", got, want)
+	}
+
+	item, ok := r.pop()
+	if !ok || item.(int) != 1 {
+		t.Fatalf("pop() = %v, %v; want 1, true", item, ok)
+	}
+}
+
+func TestRingBufferDropsOldestWhenFull(t *testing.T) {
+	r := newRingBuffer(2)
+
+	r.push(1)
+	r.push(2)
+	if dropped := r.push(3); !dropped {
+		t.Fatalf("push() into full buffer did not report a drop")
+	}
+
+	item, ok := r.pop()
+	if !ok || item.(int) != 2 {
+		t.Fatalf("pop() = %v, %v; want 2, true (item 1 should have been evicted)", item, ok)
+	}
+
+	item, ok = r.pop()
+	if !ok || item.(int) != 3 {
+		t.Fatalf("pop() = %v, %v; want 3, true", item, ok)
+	}
+
+	if _, ok := r.pop(); ok {
+		t.Fatalf("pop() on drained buffer returned ok = true")
+	}
+}
+
+func TestRingBufferPopEmpty(t *testing.T) {
+	r := newRingBuffer(2)
+	if _, ok := r.pop(); ok {
+		t.Fatalf("pop() on empty buffer returned ok = true")
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultWebhookQueueSize bounds how many flag-change diffs a
+// WebhookDispatcher will hold waiting for its dispatch goroutine before
+// dropping new ones. Diffs already handed to a delivery goroutine (see
+// run) no longer count against this bound.
+const DefaultWebhookQueueSize = 1024
+
+// WebhookConfig is the operator-facing configuration for the webhook
+// subsystem: where to deliver flag-change diffs, and the key used to sign
+// them.
+type WebhookConfig struct {
+	Endpoints  []string
+	SigningKey string
+}
+
+// FlagDiff is the JSON payload POSTed to each configured webhook endpoint
+// on every Init/Upsert/Delete. Old is nil for a newly-created flag or for
+// a full Init resync, where no prior value is tracked.
+type FlagDiff struct {
+	Environment string      `json:"environment"`
+	Key         string      `json:"key"`
+	Old         interface{} `json:"old"`
+	New         interface{} `json:"new"`
+	Version     int         `json:"version"`
+}
+
+// WebhookDispatcher delivers flag-change diffs to a configured list of
+// HTTP endpoints, signing each payload with HMAC-SHA256 so receivers can
+// verify it came from this relay. Diffs are read off a bounded queue by a
+// dedicated goroutine, which hands each diff to its own goroutine for
+// delivery, fanning out to every configured endpoint concurrently; a slow
+// or unreachable endpoint therefore cannot stall delivery to any other
+// endpoint or diff. Endpoints that keep failing past a retry budget are
+// logged to a dead-letter log rather than retried forever.
+type WebhookDispatcher struct {
+	config WebhookConfig
+	client *http.Client
+	queue  chan FlagDiff
+}
+
+// NewWebhookDispatcher starts a dispatcher with a queue of
+// DefaultWebhookQueueSize. Callers that don't want webhooks should simply
+// not construct one; SSERelayFeatureStore treats a nil dispatcher as
+// "webhooks disabled".
+func NewWebhookDispatcher(config WebhookConfig) *WebhookDispatcher {
+	d := &WebhookDispatcher{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan FlagDiff, DefaultWebhookQueueSize),
+	}
+	go d.run()
+	return d
+}
+
+// Dispatch enqueues a diff for delivery. If the queue is full the diff is
+// dropped and logged; a stalled set of webhook endpoints should not be
+// able to block the relay's flag processing.
+func (d *WebhookDispatcher) Dispatch(diff FlagDiff) {
+	select {
+	case d.queue <- diff:
+	default:
+		Error.Printf("Webhook queue full, dropping diff for %s/%s\n", diff.Environment, diff.Key)
+	}
+}
+
+func (d *WebhookDispatcher) run() {
+	for diff := range d.queue {
+		go d.deliver(diff)
+	}
+}
+
+const webhookMaxAttempts = 5
+
+// webhookInitialDelay is a var rather than a const so tests can shrink it
+// to keep retry-exhaustion tests fast.
+var webhookInitialDelay = time.Second
+
+func (d *WebhookDispatcher) deliver(diff FlagDiff) {
+	payload, err := json.Marshal(diff)
+	if err != nil {
+		Error.Printf("Error marshaling webhook payload for %s/%s: %s\n", diff.Environment, diff.Key, err.Error())
+		return
+	}
+
+	signature := d.sign(payload)
+
+	var wg sync.WaitGroup
+	for _, endpoint := range d.config.Endpoints {
+		wg.Add(1)
+		go func(endpoint string) {
+			defer wg.Done()
+			d.deliverToEndpoint(endpoint, diff, payload, signature)
+		}(endpoint)
+	}
+	wg.Wait()
+}
+
+func (d *WebhookDispatcher) deliverToEndpoint(endpoint string, diff FlagDiff, payload []byte, signature string) {
+	delay := webhookInitialDelay
+
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		if err := d.post(endpoint, payload, signature); err == nil {
+			return
+		} else if attempt == webhookMaxAttempts {
+			d.logDeadLetter(endpoint, diff, err)
+			return
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (d *WebhookDispatcher) post(endpoint string, payload []byte, signature string) error {
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-LD-Signature", signature)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook endpoint %s returned status %d", endpoint, resp.StatusCode)
+	}
+	return nil
+}
+
+func (d *WebhookDispatcher) sign(payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(d.config.SigningKey))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// logDeadLetter is the dead-letter log: once an endpoint has exhausted its
+// retry budget for a diff, we give up and log it loudly rather than retry
+// forever or buffer it indefinitely.
+func (d *WebhookDispatcher) logDeadLetter(endpoint string, diff FlagDiff, err error) {
+	Error.Printf("Giving up delivering webhook to %s for %s/%s: %s\n", endpoint, diff.Environment, diff.Key, err.Error())
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookDispatcherSignMatchesHMACSHA256(t *testing.T) {
+	d := &WebhookDispatcher{config: WebhookConfig{SigningKey: "shhh"}}
+	payload := []byte(`{"key":"a-flag"}`)
+
+	mac := hmac.New(sha256.New, []byte("shhh"))
+	mac.Write(payload)
+	want := hex.EncodeToString(mac.Sum(nil))
+
+	if got := d.sign(payload); got != want {
+		t.Fatalf("sign() = %s, want %s", got, want)
+	}
+}
+
+func TestWebhookDeliverToEndpointRetriesUntilSuccess(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	d := &WebhookDispatcher{config: WebhookConfig{SigningKey: "shhh"}, client: http.DefaultClient}
+	d.deliverToEndpoint(server.URL, FlagDiff{Key: "a-flag"}, []byte("{}"), "sig")
+
+	if got := atomic.LoadInt32(&attempts); got != 3 {
+		t.Fatalf("endpoint received %d attempts, want 3 (should stop retrying once it succeeds)", got)
+	}
+}
+
+func TestWebhookDeliverToEndpointGivesUpAfterMaxAttempts(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	origDelay := webhookInitialDelay
+	webhookInitialDelay = time.Millisecond
+	defer func() { webhookInitialDelay = origDelay }()
+
+	d := &WebhookDispatcher{config: WebhookConfig{SigningKey: "shhh"}, client: http.DefaultClient}
+	d.deliverToEndpoint(server.URL, FlagDiff{Key: "a-flag"}, []byte("{}"), "sig")
+
+	if got, want := atomic.LoadInt32(&attempts), int32(webhookMaxAttempts); got != want {
+		t.Fatalf("endpoint received %d attempts, want %d", got, want)
+	}
+}